@@ -6,9 +6,15 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// middlewareChain is the type stored in CookieHandler.middleware. It is
+// declared so every Use call can type-assert the atomic.Value back to a
+// concrete, comparable-by-type slice.
+type middlewareChain []func(Handler) Handler
+
 type CookieJar interface {
 	SetCookies(uint64)
 	Cookies() uint64
@@ -32,10 +38,9 @@ func (fn CookieReaderFunc) CookiesJar(r io.Reader) (CookieJar, error) {
 	return fn(r)
 }
 
-type filterEntry struct {
-	handler   Handler
-	evictable bool
-}
+// reapInterval is how often the background reaper walks the Store
+// looking for expired entries.
+const reapInterval = time.Minute
 
 // CookieHandler provides mechanism to hook up the message handler with an
 // opaque randomly created data. Handler is safe for concurrent use by
@@ -47,11 +52,61 @@ type CookieHandler struct {
 	// the request will be skipped.
 	Reader CookieReader
 
+	// Store persists pending cookie registrations. It defaults to an
+	// in-memory Store; assign a *FileStore (or a custom Store) before the
+	// first Handle call to survive a controller restart or to shard
+	// registrations across controllers.
+	Store Store
+
+	// Codec, when set, authenticates cookies with an HMAC tag instead of
+	// handing out plain math/rand values. Cookies are then minted with
+	// crypto/rand and verified in Serve before dispatch, so a switch or a
+	// coexisting controller cannot spoof or collide with a pending
+	// correlation. Leave nil to keep the original unauthenticated cookies.
+	Codec *SecureCookieCodec
+
 	rand *rand.Rand
 
-	handlers map[uint64]*filterEntry
-	// A lock to access the handlers from multiple concurrent goroutines.
-	lock sync.RWMutex
+	// codecMismatches counts requests whose cookie failed Codec
+	// verification and so skipped exact-match dispatch.
+	codecMismatches uint64
+
+	// registry resolves the HandlerID a Store entry carries back to the
+	// live Handler it was registered with. Only entries made through
+	// RegisterHandler/HandleID go through it; Handle and its variants keep
+	// their Handler directly on the Entry instead (see Entry.handler),
+	// since a registry entry can otherwise never be removed again.
+	registry *HandlerRegistry
+
+	// reapOnce guards the lazy startup of the background reaper, which is
+	// only needed once a TTL-based handler is registered. reapMu guards
+	// reapDone itself, since startReaper (writer) and Close (reader) can
+	// otherwise race on it from different goroutines.
+	reapOnce sync.Once
+	reapMu   sync.Mutex
+	reapDone chan struct{}
+
+	// closeOnce makes Close idempotent: calling it more than once must not
+	// panic on a double close of reapDone.
+	closeOnce sync.Once
+
+	// middleware holds the composed middlewareChain applied around every
+	// dispatched handler. It is an atomic.Value rather than a plain slice
+	// guarded by a lock since it is written rarely (Use is typically only
+	// called during setup) and read on every Serve.
+	middleware atomic.Value
+
+	// writeMu serializes the read-copy-store updates of middleware and
+	// masks, so concurrent Use or HandleMask calls cannot drop each other.
+	writeMu sync.Mutex
+
+	// masks holds the []maskEntry predicates registered by HandleMask,
+	// consulted once an exact-match lookup in Serve fails.
+	masks atomic.Value
+
+	// defaultHandler, when set via HandleDefault, receives any request
+	// whose cookie matched neither an exact entry nor a mask pattern.
+	defaultHandler atomic.Value
 }
 
 // NewCookieHandler returns a new CookieHandler. The CookieHandler suitable
@@ -60,7 +115,8 @@ func NewCookieHandler() *CookieHandler {
 	seed := time.Now().UTC().UnixNano()
 
 	return &CookieHandler{
-		handlers: make(map[uint64]*filterEntry),
+		Store:    NewMemoryStore(),
+		registry: NewHandlerRegistry(),
 		rand:     rand.New(rand.NewSource(seed)),
 	}
 }
@@ -71,13 +127,7 @@ func NewCookieHandler() *CookieHandler {
 // cookie. If the request cookie matches the registered one, the given
 // handler will be used to process the request.
 func (h *CookieHandler) Handle(jar CookieJar, handler Handler) {
-	cookies := uint64(h.rand.Int63())
-	jar.SetCookies(cookies)
-
-	h.lock.Lock()
-	defer h.lock.Unlock()
-
-	h.handlers[cookies] = &filterEntry{handler, false}
+	h.handle(jar, handler, time.Time{}, 0)
 }
 
 // Handle registers the handler function for the given cookie pattern.
@@ -85,16 +135,190 @@ func (h *CookieHandler) HandleFunc(jar CookieJar, handler HandlerFunc) {
 	h.Handle(jar, handler)
 }
 
+// HandleWithTTL registers the handler for the given cookie pattern and
+// evicts it once ttl elapses, even if no matching reply ever arrives.
+// This keeps long-lived controllers from accumulating handler entries for
+// stat or barrier replies that never come back.
+func (h *CookieHandler) HandleWithTTL(jar CookieJar, handler Handler, ttl time.Duration) {
+	h.handle(jar, handler, time.Now().Add(ttl), 0)
+}
+
+// HandleOnce registers the handler for the given cookie pattern and evicts
+// it as soon as it has been dispatched to once.
+func (h *CookieHandler) HandleOnce(jar CookieJar, handler Handler) {
+	h.handle(jar, handler, time.Time{}, 1)
+}
+
+func (h *CookieHandler) handle(jar CookieJar, handler Handler, expiresAt time.Time, hits int) {
+	cookies := h.reserveCookie()
+	jar.SetCookies(cookies)
+
+	h.Store.Put(cookies, &Entry{Cookie: cookies, handler: handler, ExpiresAt: expiresAt, Hits: hits})
+
+	if !expiresAt.IsZero() {
+		h.startReaper()
+	}
+}
+
+// RegisterHandler makes handler resolvable by id. A Store entry only ever
+// references a handler by id, so any handler that should still be
+// reachable after a controller restart must be registered here - typically
+// at boot, before Load is called - instead of passed directly to Handle.
+func (h *CookieHandler) RegisterHandler(id string, handler Handler) {
+	h.registry.Register(id, handler)
+}
+
+// HandleID registers the handler previously passed to RegisterHandler for
+// the given cookie pattern. Unlike Handle, the resulting entry references
+// its handler by a stable id rather than holding the Handler itself, so it
+// can be resumed by Load after a controller restart.
+func (h *CookieHandler) HandleID(jar CookieJar, id string) {
+	cookies := h.reserveCookie()
+	jar.SetCookies(cookies)
+
+	h.Store.Put(cookies, &Entry{Cookie: cookies, HandlerID: id})
+}
+
+// newCookie mints a fresh cookie value, signing it with Codec when one is
+// configured and falling back to the plain math/rand source otherwise (or
+// if the signing attempt itself fails, which in practice only happens if
+// the system's crypto/rand source is unavailable).
+func (h *CookieHandler) newCookie() uint64 {
+	if h.Codec != nil {
+		if cookie, err := h.Codec.Sign(); err == nil {
+			return cookie
+		}
+	}
+
+	return uint64(h.rand.Int63())
+}
+
+// maxCookieAttempts bounds how many times reserveCookie retries a freshly
+// minted value that already names a pending entry.
+const maxCookieAttempts = 8
+
+// reserveCookie mints a cookie that does not currently name a pending
+// Store entry, retrying on collision, and returns the last value tried if
+// every attempt collided.
+//
+// A collision is unlikely with the 63-bit math/rand cookie, but Codec
+// caps usable entropy at its nonce width - 24 bits, or ~16.7M values, for
+// the default SecureCookieCodec - so deployments signing cookies should
+// keep the number of outstanding (not yet replied-to) correlations well
+// below that to keep the birthday-collision probability negligible; this
+// retry only guards against a colliding value silently overwriting
+// another pending entry, it does not widen the nonce space itself.
+func (h *CookieHandler) reserveCookie() uint64 {
+	cookie := h.newCookie()
+
+	for attempt := 1; attempt < maxCookieAttempts; attempt++ {
+		if _, exists := h.Store.Get(cookie); !exists {
+			break
+		}
+		cookie = h.newCookie()
+	}
+
+	return cookie
+}
+
+// Load primes the reaper from whatever the Store already holds. Call it
+// once at startup, after every resumable handler has been registered with
+// RegisterHandler, so pending request/reply correlations persisted by a
+// *FileStore (or similar) are picked back up across a controller restart.
+func (h *CookieHandler) Load() {
+	needsReaper := false
+
+	h.Store.Range(func(cookie uint64, e *Entry) bool {
+		if !e.ExpiresAt.IsZero() {
+			needsReaper = true
+			return false
+		}
+		return true
+	})
+
+	if needsReaper {
+		h.startReaper()
+	}
+}
+
+// Use appends middleware to the chain wrapped around every handler
+// dispatched by Serve. Middleware runs in the order given: the first mw
+// wraps the handler returned by the rest of the chain, so it observes the
+// request first and the response last (e.g. register logging before
+// metrics, and metrics before recovery, so a recovered panic is still
+// logged and timed).
+//
+// Use is meant to be called during setup; it is safe for concurrent use
+// but does not affect requests already in flight.
+func (h *CookieHandler) Use(mw ...func(Handler) Handler) {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+
+	existing, _ := h.middleware.Load().(middlewareChain)
+
+	chain := make(middlewareChain, 0, len(existing)+len(mw))
+	chain = append(chain, existing...)
+	chain = append(chain, mw...)
+
+	h.middleware.Store(chain)
+}
+
+// chain wraps handler with every middleware registered through Use.
+func (h *CookieHandler) chain(handler Handler) Handler {
+	mw, _ := h.middleware.Load().(middlewareChain)
+
+	for i := len(mw) - 1; i >= 0; i-- {
+		handler = mw[i](handler)
+	}
+
+	return handler
+}
+
 // Unhandle removes the handler for the given cookie pattern.
 func (h *CookieHandler) Unhandle(jar CookieJar) {
-	h.lock.Lock()
-	defer h.lock.Unlock()
+	h.Store.Delete(jar.Cookies())
+}
 
-	delete(h.handlers, jar.Cookies())
+// maskEntry is a wildcard predicate registered by HandleMask: it matches
+// every cookie agreeing with cookie on the bits set in mask.
+type maskEntry struct {
+	cookie  uint64
+	mask    uint64
+	handler Handler
+}
+
+// HandleMask registers handler for every incoming cookie matching
+// incoming&mask == jar.Cookies()&mask. Unlike Handle, a mask entry is not
+// consumed by a match: it keeps matching for as long as it is registered,
+// and - once the exact-match lookup in Serve fails - every mask entry
+// whose pattern matches the incoming cookie is dispatched to, in
+// registration order. This supports patterns such as "any reply from
+// flows I installed with the top 16 bits set to my appID", without
+// registering a handler per xid.
+func (h *CookieHandler) HandleMask(jar CookieJar, mask uint64, handler Handler) {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+
+	existing, _ := h.masks.Load().([]maskEntry)
+
+	entries := make([]maskEntry, len(existing), len(existing)+1)
+	copy(entries, existing)
+	entries = append(entries, maskEntry{cookie: jar.Cookies(), mask: mask, handler: handler})
+
+	h.masks.Store(entries)
+}
+
+// HandleDefault registers handler to receive any request whose cookie
+// matched neither an exact Handle entry nor a HandleMask pattern. This is
+// useful for asynchronous events such as PacketIn, which carry cookie==0
+// or a flow-installer-supplied tag with no single owning handler.
+func (h *CookieHandler) HandleDefault(handler Handler) {
+	h.defaultHandler.Store(handler)
 }
 
 // Serve implements Handler interface. Serve dispatches the request to the
-// handler whose cookie matches.
+// handler whose cookie matches, falling back to any matching HandleMask
+// patterns and then to the HandleDefault handler.
 func (h *CookieHandler) Serve(rw ResponseWriter, r *Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -107,19 +331,144 @@ func (h *CookieHandler) Serve(rw ResponseWriter, r *Request) {
 		return
 	}
 
-	h.lock.RLock()
-	defer h.lock.RUnlock()
+	cookie := jar.Cookies()
 
-	// Search handler for the cookie.
-	entry, ok := h.handlers[jar.Cookies()]
-	if !ok {
+	// Codec only authenticates cookies this CookieHandler minted itself,
+	// so a mismatch must fall through to the mask/default paths rather
+	// than drop the request outright - otherwise cookie==0 PacketIn events
+	// and flow-installer-supplied tags, which HandleMask/HandleDefault
+	// exist to catch, would never reach a handler once Codec is set.
+	if h.Codec == nil || h.Codec.Verify(cookie) {
+		if handler, ok := h.dispatch(cookie); ok {
+			r.Body = bytes.NewBuffer(body)
+			h.chain(handler).Serve(rw, r)
+			return
+		}
+	} else {
+		atomic.AddUint64(&h.codecMismatches, 1)
+	}
+
+	matched := false
+	for _, me := range h.matchingMasks(cookie) {
+		matched = true
+		r.Body = bytes.NewBuffer(body)
+		h.chain(me.handler).Serve(rw, r)
+	}
+	if matched {
 		return
 	}
 
-	if entry.evictable {
-		delete(h.handlers, jar.Cookies())
+	if def, ok := h.defaultHandler.Load().(Handler); ok {
+		r.Body = bytes.NewBuffer(body)
+		h.chain(def).Serve(rw, r)
+	}
+}
+
+// matchingMasks returns every registered HandleMask entry whose pattern
+// matches cookie, in registration order.
+func (h *CookieHandler) matchingMasks(cookie uint64) []maskEntry {
+	all, _ := h.masks.Load().([]maskEntry)
+
+	var matched []maskEntry
+	for _, me := range all {
+		if cookie&me.mask == me.cookie&me.mask {
+			matched = append(matched, me)
+		}
+	}
+
+	return matched
+}
+
+// CodecMismatches reports how many incoming requests skipped exact-match
+// dispatch because their cookie failed Codec verification (they may still
+// have been handled by a mask or default handler). Wire it into a metrics
+// system (e.g. as a Prometheus counter) to alert on spoofing or
+// cross-controller cookie collisions.
+func (h *CookieHandler) CodecMismatches() uint64 {
+	return atomic.LoadUint64(&h.codecMismatches)
+}
+
+// dispatch resolves the handler registered for cookie, if any. It defers
+// the TTL-expiry check and hit-count eviction to Store.Consume, which
+// performs them atomically: a Get followed by a separate Put/Delete here
+// would let two concurrent Serve calls both observe, and act on, the same
+// entry's last remaining hit.
+func (h *CookieHandler) dispatch(cookie uint64) (Handler, bool) {
+	entry, ok := h.Store.Consume(cookie, time.Now())
+	if !ok {
+		return nil, false
+	}
+
+	if entry.handler != nil {
+		return entry.handler, true
 	}
 
-	r.Body = bytes.NewBuffer(body)
-	entry.handler.Serve(rw, r)
+	handler, ok := h.registry.lookup(entry.HandlerID)
+	if !ok {
+		h.Store.Delete(cookie)
+		return nil, false
+	}
+
+	return handler, true
+}
+
+// startReaper lazily starts the background goroutine that periodically
+// evicts expired entries, so controllers that never register a TTL-based
+// handler don't pay for an idle goroutine.
+func (h *CookieHandler) startReaper() {
+	h.reapOnce.Do(func() {
+		h.reapMu.Lock()
+		h.reapDone = make(chan struct{})
+		h.reapMu.Unlock()
+
+		go h.reapLoop()
+	})
+}
+
+func (h *CookieHandler) reapLoop() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.reap()
+		case <-h.reapDone:
+			return
+		}
+	}
+}
+
+// reap removes every entry that has expired since the last sweep.
+func (h *CookieHandler) reap() {
+	now := time.Now()
+
+	var expired []uint64
+	h.Store.Range(func(cookie uint64, e *Entry) bool {
+		if e.expired(now) {
+			expired = append(expired, cookie)
+		}
+		return true
+	})
+
+	for _, cookie := range expired {
+		h.Store.Delete(cookie)
+	}
+}
+
+// Close stops the background reaper goroutine, if one was ever started. It
+// is safe to call Close even when no TTL-based handler was registered, and
+// safe to call more than once.
+func (h *CookieHandler) Close() error {
+	h.closeOnce.Do(func() {
+		h.reapMu.Lock()
+		done := h.reapDone
+		h.reapMu.Unlock()
+
+		if done != nil {
+			close(done)
+		}
+	})
+
+	return nil
 }
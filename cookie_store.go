@@ -0,0 +1,323 @@
+package of
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entry is the record of a pending cookie registration. HandlerID is the
+// serializable part: handlers close over process-local state and cannot
+// be serialized, so a Store only ever needs to persist the id, and
+// CookieHandler resolves it back to a Handler through its HandlerRegistry.
+//
+// handler carries the live Handler directly for registrations made through
+// Handle and its variants, which have no stable id to register. It is
+// unexported and deliberately excluded from serialization (encoding/json
+// skips unexported fields): such registrations are in-process only and are
+// not expected to survive a restart.
+type Entry struct {
+	Cookie    uint64
+	HandlerID string
+	ExpiresAt time.Time
+	Hits      int
+
+	handler Handler
+}
+
+// expired reports whether e should be treated as absent at now.
+func (e *Entry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && now.After(e.ExpiresAt)
+}
+
+// Store is the persistence backend for pending cookie registrations,
+// similar in spirit to gorilla/sessions' store abstraction. Implementations
+// must be safe for concurrent use by multiple goroutines.
+//
+// CookieHandler ships with an in-memory Store by default and a file-backed
+// Store for single-process durability. A Redis- or etcd-backed Store can
+// be added the same way for multi-controller HA deployments, where cookie
+// ownership needs to be shared or handed off between controllers.
+type Store interface {
+	Get(cookie uint64) (*Entry, bool)
+	Put(cookie uint64, e *Entry)
+	Delete(cookie uint64)
+	Range(func(cookie uint64, e *Entry) bool)
+
+	// Consume atomically resolves the entry registered for cookie against
+	// now, evicting it if it is absent or expired, and otherwise
+	// decrementing its remaining hit count (evicting it if that reaches
+	// zero). Implementations must perform the check-evict-decrement
+	// sequence under a single lock, so that two concurrent callers
+	// consuming the same cookie can never both observe - and act on - its
+	// last remaining hit. The returned *Entry is a snapshot safe to read
+	// without further synchronization.
+	Consume(cookie uint64, now time.Time) (*Entry, bool)
+}
+
+// memoryStore is the default Store: a plain map guarded by a RWMutex. It
+// does not survive a controller restart.
+type memoryStore struct {
+	mu      sync.RWMutex
+	entries map[uint64]*Entry
+}
+
+// NewMemoryStore returns a Store that keeps entries in memory only.
+func NewMemoryStore() Store {
+	return &memoryStore{entries: make(map[uint64]*Entry)}
+}
+
+func (s *memoryStore) Get(cookie uint64) (*Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.entries[cookie]
+	return e, ok
+}
+
+func (s *memoryStore) Put(cookie uint64, e *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[cookie] = e
+}
+
+func (s *memoryStore) Delete(cookie uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, cookie)
+}
+
+func (s *memoryStore) Range(fn func(cookie uint64, e *Entry) bool) {
+	s.mu.RLock()
+	entries := make(map[uint64]*Entry, len(s.entries))
+	for cookie, e := range s.entries {
+		entries[cookie] = e
+	}
+	s.mu.RUnlock()
+
+	for cookie, e := range entries {
+		if !fn(cookie, e) {
+			return
+		}
+	}
+}
+
+func (s *memoryStore) Consume(cookie uint64, now time.Time) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[cookie]
+	if !ok {
+		return nil, false
+	}
+
+	if e.expired(now) {
+		delete(s.entries, cookie)
+		return nil, false
+	}
+
+	snapshot := *e
+
+	if e.Hits > 0 {
+		e.Hits--
+		if e.Hits == 0 {
+			delete(s.entries, cookie)
+		}
+	}
+
+	return &snapshot, true
+}
+
+// FileStore is a Store backed by a single JSON file. It persists
+// {cookie, expiry, handlerID} tuples on every write so pending
+// request/reply correlations can be resumed after a controller restart by
+// calling NewFileStore again with the same path and re-registering
+// resumable handlers through HandlerRegistry before CookieHandler.Load.
+//
+// FileStore is meant for a single controller process; deployments running
+// several controllers for HA should implement Store against a shared
+// backend such as Redis or etcd instead.
+type FileStore struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[uint64]*Entry
+
+	// persistMu serializes persist's snapshot-encode-rename sequence.
+	// Without it, two overlapping writers could both create and write the
+	// same fixed ".tmp" path through independent file descriptors,
+	// renaming interleaved or truncated JSON into place.
+	persistMu sync.Mutex
+}
+
+// NewFileStore opens path, loading any entries persisted by a previous
+// run. If path does not yet exist, the store starts empty and the file is
+// first written by the next change to the store.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, entries: make(map[uint64]*Entry)}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*Entry
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		s.entries[e.Cookie] = e
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) Get(cookie uint64) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[cookie]
+	return e, ok
+}
+
+func (s *FileStore) Put(cookie uint64, e *Entry) {
+	s.mu.Lock()
+	s.entries[cookie] = e
+	s.mu.Unlock()
+
+	s.persist()
+}
+
+func (s *FileStore) Delete(cookie uint64) {
+	s.mu.Lock()
+	delete(s.entries, cookie)
+	s.mu.Unlock()
+
+	s.persist()
+}
+
+func (s *FileStore) Range(fn func(cookie uint64, e *Entry) bool) {
+	s.mu.Lock()
+	entries := make(map[uint64]*Entry, len(s.entries))
+	for cookie, e := range s.entries {
+		entries[cookie] = e
+	}
+	s.mu.Unlock()
+
+	for cookie, e := range entries {
+		if !fn(cookie, e) {
+			return
+		}
+	}
+}
+
+func (s *FileStore) Consume(cookie uint64, now time.Time) (*Entry, bool) {
+	s.mu.Lock()
+
+	e, ok := s.entries[cookie]
+	if !ok {
+		s.mu.Unlock()
+		return nil, false
+	}
+
+	if e.expired(now) {
+		delete(s.entries, cookie)
+		s.mu.Unlock()
+		s.persist()
+		return nil, false
+	}
+
+	snapshot := *e
+	changed := false
+
+	if e.Hits > 0 {
+		e.Hits--
+		changed = true
+		if e.Hits == 0 {
+			delete(s.entries, cookie)
+		}
+	}
+
+	s.mu.Unlock()
+
+	if changed {
+		s.persist()
+	}
+
+	return &snapshot, true
+}
+
+// persist rewrites the backing file with the current entry set. Writes go
+// to a temporary file first and are renamed into place, so a crash
+// mid-write never leaves a truncated store behind. persistMu serializes
+// the whole snapshot-encode-rename sequence across calls, so two
+// overlapping Put/Delete/Consume calls can never write the shared ".tmp"
+// path at the same time. persist logs nothing and swallows errors on
+// write, matching Store's error-free interface; the in-memory copy served
+// by Get/Range stays authoritative regardless.
+func (s *FileStore) persist() {
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
+	s.mu.Lock()
+	entries := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, *e)
+	}
+	s.mu.Unlock()
+
+	tmp := s.path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+
+	if err := json.NewEncoder(f).Encode(entries); err != nil {
+		f.Close()
+		return
+	}
+
+	if err := f.Close(); err != nil {
+		return
+	}
+
+	os.Rename(tmp, s.path)
+}
+
+// HandlerRegistry resolves a stable handler id to a live Handler. A Store
+// entry only ever references a handler by id, so CookieHandler consults a
+// HandlerRegistry at dispatch time to find the Handler to invoke.
+type HandlerRegistry struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+// NewHandlerRegistry returns an empty HandlerRegistry.
+func NewHandlerRegistry() *HandlerRegistry {
+	return &HandlerRegistry{handlers: make(map[string]Handler)}
+}
+
+// Register makes handler resolvable by id.
+func (r *HandlerRegistry) Register(id string, handler Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.handlers[id] = handler
+}
+
+func (r *HandlerRegistry) lookup(id string) (Handler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	handler, ok := r.handlers[id]
+	return handler, ok
+}
@@ -0,0 +1,84 @@
+package of
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreConsumeExpired(t *testing.T) {
+	s := NewMemoryStore()
+	s.Put(1, &Entry{Cookie: 1, ExpiresAt: time.Now().Add(-time.Second)})
+
+	if _, ok := s.Consume(1, time.Now()); ok {
+		t.Fatal("Consume returned an entry past its ExpiresAt")
+	}
+	if _, ok := s.Get(1); ok {
+		t.Fatal("Consume did not evict the expired entry")
+	}
+}
+
+func TestMemoryStoreConsumeHitsConcurrent(t *testing.T) {
+	s := NewMemoryStore()
+	s.Put(1, &Entry{Cookie: 1, Hits: 1})
+
+	const attempts = 50
+
+	var wg sync.WaitGroup
+	oks := make([]bool, attempts)
+
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, ok := s.Consume(1, time.Now())
+			oks[i] = ok
+		}(i)
+	}
+	wg.Wait()
+
+	matches := 0
+	for _, ok := range oks {
+		if ok {
+			matches++
+		}
+	}
+
+	if matches != 1 {
+		t.Fatalf("Consume resolved the single-hit entry %d times, want exactly 1", matches)
+	}
+	if _, ok := s.Get(1); ok {
+		t.Fatal("entry was not evicted after its only hit was consumed")
+	}
+}
+
+func TestFileStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+
+	s.Put(1, &Entry{Cookie: 1, HandlerID: "stat-reply", Hits: 2})
+	s.Put(2, &Entry{Cookie: 2, HandlerID: "barrier-reply"})
+	s.Delete(2)
+
+	reloaded, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore (reload): %v", err)
+	}
+
+	e, ok := reloaded.Get(1)
+	if !ok {
+		t.Fatal("reloaded store is missing the entry persisted before restart")
+	}
+	if e.HandlerID != "stat-reply" || e.Hits != 2 {
+		t.Fatalf("reloaded entry = %+v, want HandlerID=stat-reply Hits=2", e)
+	}
+
+	if _, ok := reloaded.Get(2); ok {
+		t.Fatal("reloaded store resurrected an entry that was deleted before restart")
+	}
+}
@@ -0,0 +1,124 @@
+package of
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+type testCookieJar struct {
+	cookie uint64
+}
+
+func (j *testCookieJar) SetCookies(c uint64) { j.cookie = c }
+func (j *testCookieJar) Cookies() uint64     { return j.cookie }
+
+type cookieReaderFunc func(io.Reader) (CookieJar, error)
+
+func (fn cookieReaderFunc) ReadCookie(r io.Reader) (CookieJar, error) { return fn(r) }
+
+// testCookieReader treats the whole request body as the big-endian encoded
+// cookie, so tests don't need to speak the real OpenFlow wire format.
+func testCookieReader() CookieReader {
+	return cookieReaderFunc(func(r io.Reader) (CookieJar, error) {
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+
+		var cookie uint64
+		for _, b := range body {
+			cookie = cookie<<8 | uint64(b)
+		}
+
+		return &testCookieJar{cookie: cookie}, nil
+	})
+}
+
+func cookieRequest(cookie uint64) *Request {
+	var buf [8]byte
+	for i := 7; i >= 0; i-- {
+		buf[i] = byte(cookie)
+		cookie >>= 8
+	}
+
+	return &Request{Body: bytes.NewReader(buf[:])}
+}
+
+func TestCookieHandlerDispatch(t *testing.T) {
+	h := NewCookieHandler()
+	h.Reader = testCookieReader()
+
+	jar := &testCookieJar{}
+	called := false
+	h.Handle(jar, HandlerFunc(func(rw ResponseWriter, r *Request) { called = true }))
+
+	h.Serve(nil, cookieRequest(jar.Cookies()))
+
+	if !called {
+		t.Fatal("Serve did not dispatch to the handler registered for the matching cookie")
+	}
+}
+
+func TestCookieHandlerHandleOnceEvictsAfterFirstHit(t *testing.T) {
+	h := NewCookieHandler()
+	h.Reader = testCookieReader()
+
+	jar := &testCookieJar{}
+	hits := 0
+	h.HandleOnce(jar, HandlerFunc(func(rw ResponseWriter, r *Request) { hits++ }))
+
+	h.Serve(nil, cookieRequest(jar.Cookies()))
+	h.Serve(nil, cookieRequest(jar.Cookies()))
+
+	if hits != 1 {
+		t.Fatalf("handler was dispatched to %d times, want exactly 1", hits)
+	}
+}
+
+func TestCookieHandlerReapEvictsExpired(t *testing.T) {
+	h := NewCookieHandler()
+	defer h.Close()
+
+	jar := &testCookieJar{}
+	h.HandleWithTTL(jar, HandlerFunc(func(rw ResponseWriter, r *Request) {}), -time.Second)
+
+	h.reap()
+
+	if _, ok := h.Store.Get(jar.Cookies()); ok {
+		t.Fatal("reap did not evict an already-expired entry")
+	}
+}
+
+func TestCookieHandlerCodecMismatchFallsThroughToDefault(t *testing.T) {
+	h := NewCookieHandler()
+	h.Reader = testCookieReader()
+	h.Codec = NewSecureCookieCodec([]byte("key"))
+
+	defaulted := false
+	h.HandleDefault(HandlerFunc(func(rw ResponseWriter, r *Request) { defaulted = true }))
+
+	// cookie==0 never verifies against a configured Codec, much like a
+	// PacketIn event that carries no cookie of its own.
+	h.Serve(nil, cookieRequest(0))
+
+	if !defaulted {
+		t.Fatal("Serve did not fall through to HandleDefault when Codec verification failed")
+	}
+}
+
+func TestCookieHandlerCloseIsIdempotent(t *testing.T) {
+	h := NewCookieHandler()
+
+	jar := &testCookieJar{}
+	h.HandleWithTTL(jar, HandlerFunc(func(rw ResponseWriter, r *Request) {}), time.Minute)
+
+	if err := h.Close(); err != nil {
+		t.Fatalf("first Close: %v", err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
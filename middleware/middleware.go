@@ -0,0 +1,56 @@
+// Package middleware provides a few built-in CookieHandler middlewares -
+// panic recovery, request logging and handler timing - so callers get
+// these cross-cutting concerns without every registered handler
+// re-implementing them. Use of.CookieHandler.Use to install them.
+package middleware
+
+import (
+	"log"
+	"time"
+
+	of "github.com/zewei/openflow"
+)
+
+// RecoverMiddleware recovers from panics raised by the wrapped handler, so
+// that a single misbehaving handler cannot take down the goroutine
+// dispatching OpenFlow requests.
+func RecoverMiddleware(next of.Handler) of.Handler {
+	return of.HandlerFunc(func(rw of.ResponseWriter, r *of.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("of: recovered from handler panic: %v", err)
+			}
+		}()
+
+		next.Serve(rw, r)
+	})
+}
+
+// LoggingMiddleware logs how long the wrapped handler took to process
+// each request it was dispatched.
+func LoggingMiddleware(next of.Handler) of.Handler {
+	return of.HandlerFunc(func(rw of.ResponseWriter, r *of.Request) {
+		start := time.Now()
+		next.Serve(rw, r)
+		log.Printf("of: handled request in %s", time.Since(start))
+	})
+}
+
+// Observer is the minimal interface MetricsMiddleware needs from a timing
+// collector. prometheus.Histogram and prometheus.Summary both satisfy it
+// through their Observe method.
+type Observer interface {
+	Observe(seconds float64)
+}
+
+// MetricsMiddleware times every request the wrapped handler processes and
+// reports the duration, in seconds, to o.
+func MetricsMiddleware(o Observer) func(of.Handler) of.Handler {
+	return func(next of.Handler) of.Handler {
+		return of.HandlerFunc(func(rw of.ResponseWriter, r *of.Request) {
+			start := time.Now()
+			next.Serve(rw, r)
+			o.Observe(time.Since(start).Seconds())
+		})
+	}
+}